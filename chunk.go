@@ -0,0 +1,173 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Chunk is Lua source that has already been parsed and compiled to
+// bytecode, ready to be loaded or called on any Engine repeatedly without
+// re-parsing.
+type Chunk struct {
+	// Name is the chunk name used in Lua tracebacks and error messages,
+	// typically the source file path or a descriptive label.
+	Name string
+
+	proto *lua.FunctionProto
+}
+
+// CompileString parses and compiles src into a reusable Chunk, using name as
+// its chunk name for tracebacks and error messages.
+func CompileString(name, src string) (*Chunk, error) {
+	return compile(name, strings.NewReader(src))
+}
+
+// CompileFile parses and compiles the Lua source at path into a reusable
+// Chunk.
+func CompileFile(path string) (*Chunk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return compile(path, f)
+}
+
+// compile parses and compiles Lua source read from r into a Chunk.
+func compile(name string, r io.Reader) (*Chunk, error) {
+	stmts, err := parse.Parse(r, name)
+	if err != nil {
+		return nil, fmt.Errorf("engine: parse %s: %v", name, err)
+	}
+
+	proto, err := lua.Compile(stmts, name)
+	if err != nil {
+		return nil, fmt.Errorf("engine: compile %s: %v", name, err)
+	}
+
+	return &Chunk{Name: name, proto: proto}, nil
+}
+
+// LoadChunk runs a compiled Chunk through the Lua interpreter, the
+// bytecode-cached equivalent of LoadFile/LoadString.
+func (e *Engine) LoadChunk(c *Chunk) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.withLimits(func() error {
+		err := e.state.CallByParam(lua.P{
+			Fn:      e.state.NewFunctionFromProto(c.proto),
+			NRet:    0,
+			Protect: true,
+		})
+		if err != nil {
+			return e.wrapError(c.Name, err)
+		}
+
+		return nil
+	})
+}
+
+// CallChunk runs a compiled Chunk as a callable function with the given
+// arguments, the bytecode-cached equivalent of Call. retCount is the number
+// of return values to collect into the returned slice.
+func (e *Engine) CallChunk(c *Chunk, retCount int, args ...interface{}) ([]*Value, error) {
+	luaParams := make([]lua.LValue, len(args))
+	for i, iface := range args {
+		luaParams[i] = e.ValueFor(iface).lval
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var retVals []*Value
+	err := e.withLimits(func() error {
+		err := e.state.CallByParam(lua.P{
+			Fn:      e.state.NewFunctionFromProto(c.proto),
+			NRet:    retCount,
+			Protect: true,
+		}, luaParams...)
+		if err != nil {
+			return e.wrapError(c.Name, err)
+		}
+
+		retVals = make([]*Value, retCount)
+		for i := 0; i < retCount; i++ {
+			retVals[i] = newValue(e.state.Get(-retCount + i))
+		}
+		e.state.Pop(retCount)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return retVals, nil
+}
+
+// chunkCacheEntry pairs a compiled Chunk with the mtime of the file it was
+// compiled from, so ChunkCache can tell when it's gone stale.
+type chunkCacheEntry struct {
+	chunk   *Chunk
+	modTime time.Time
+}
+
+// ChunkCache compiles Lua files on first use and keeps the result keyed by
+// path, so a server executing the same script per-request compiles it once
+// and runs it many times against pooled engines. Safe for concurrent use.
+type ChunkCache struct {
+	mu      sync.Mutex
+	entries map[string]chunkCacheEntry
+}
+
+// NewChunkCache creates an empty ChunkCache.
+func NewChunkCache() *ChunkCache {
+	return &ChunkCache{
+		entries: make(map[string]chunkCacheEntry),
+	}
+}
+
+// Load returns the cached Chunk for path, recompiling it if it's never been
+// compiled or the file's mtime has changed since it last was.
+func (c *ChunkCache) Load(path string) (*Chunk, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[path]; ok && entry.modTime.Equal(info.ModTime()) {
+		return entry.chunk, nil
+	}
+
+	chunk, err := CompileFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.entries[path] = chunkCacheEntry{chunk: chunk, modTime: info.ModTime()}
+
+	return chunk, nil
+}
+
+// Invalidate removes path from the cache, forcing the next Load to
+// recompile it regardless of mtime.
+func (c *ChunkCache) Invalidate(path string) {
+	c.mu.Lock()
+	delete(c.entries, path)
+	c.mu.Unlock()
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadChunkRunsCompiledSource(t *testing.T) {
+	c, err := CompileString("test", `x = 41 + 1`)
+	if err != nil {
+		t.Fatalf("CompileString: %v", err)
+	}
+
+	e := NewEngine()
+	defer e.Close()
+
+	if err := e.LoadChunk(c); err != nil {
+		t.Fatalf("LoadChunk: %v", err)
+	}
+	if e.GetGlobal("x").AsNumber() != 42 {
+		t.Fatalf("x = %v, want 42", e.GetGlobal("x").AsNumber())
+	}
+}
+
+func TestLoadChunkThenCallReturnsDistinctValuesPerSlot(t *testing.T) {
+	c, err := CompileString("test", `
+		function f(a, b)
+			return a, b, a + b
+		end
+		return f
+	`)
+	if err != nil {
+		t.Fatalf("CompileString: %v", err)
+	}
+
+	e := NewEngine()
+	defer e.Close()
+
+	if err := e.LoadChunk(c); err != nil {
+		t.Fatalf("LoadChunk: %v", err)
+	}
+
+	retVals, err := e.Call("f", 3, 10, 20)
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if len(retVals) != 3 {
+		t.Fatalf("len(retVals) = %d, want 3", len(retVals))
+	}
+	if retVals[0].AsNumber() != 10 || retVals[1].AsNumber() != 20 || retVals[2].AsNumber() != 30 {
+		t.Fatalf("retVals = [%v %v %v], want [10 20 30]", retVals[0], retVals[1], retVals[2])
+	}
+}
+
+func TestChunkCacheRecompilesOnModTimeChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script.lua")
+
+	if err := os.WriteFile(path, []byte(`x = 1`), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cache := NewChunkCache()
+	first, err := cache.Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	again, err := cache.Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if again != first {
+		t.Fatal("Load recompiled an unchanged file instead of returning the cached Chunk")
+	}
+
+	// Advance the mtime so the cache sees a real change even on filesystems
+	// with coarse mtime resolution.
+	newTime := time.Now().Add(time.Second)
+	if err := os.WriteFile(path, []byte(`x = 2`), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chtimes(path, newTime, newTime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	updated, err := cache.Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if updated == first {
+		t.Fatal("Load returned the stale cached Chunk after the file's mtime changed")
+	}
+}
+
+func TestChunkCacheInvalidateForcesRecompile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script.lua")
+
+	if err := os.WriteFile(path, []byte(`x = 1`), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cache := NewChunkCache()
+	first, err := cache.Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	cache.Invalidate(path)
+
+	again, err := cache.Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if again == first {
+		t.Fatal("Load returned the cached Chunk after Invalidate, want a fresh recompile")
+	}
+}
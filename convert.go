@@ -0,0 +1,355 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Interface returns the Value as a plain Go interface{}: nil, bool, float64,
+// string, []interface{}, or map[string]interface{}. Used by PopInterface to
+// hand callers of RegisterFunc a value they don't need the lua package to
+// inspect.
+func (v *Value) Interface() interface{} {
+	return luaToInterface(v.lval)
+}
+
+// AsMap returns the Value's table as a map[string]*Value, keyed by each
+// string key found in the table. Non-string keys are ignored. Returns nil if
+// the Value does not wrap a table.
+func (v *Value) AsMap() map[string]*Value {
+	if !v.isTable() {
+		return nil
+	}
+
+	out := make(map[string]*Value)
+	v.asTable().ForEach(func(k, val lua.LValue) {
+		if key, ok := k.(lua.LString); ok {
+			out[string(key)] = newValue(val)
+		}
+	})
+
+	return out
+}
+
+// AsSlice returns the Value's table as a []*Value, using the table's array
+// part (indices 1..Len()). Returns nil if the Value does not wrap a table.
+func (v *Value) AsSlice() []*Value {
+	if !v.isTable() {
+		return nil
+	}
+
+	t := v.asTable()
+	out := make([]*Value, t.Len())
+	for i := 1; i <= t.Len(); i++ {
+		out[i-1] = newValue(t.RawGetInt(i))
+	}
+
+	return out
+}
+
+// AsGoMap fills target, which must be a non-nil pointer to a map, from this
+// Value's table.
+func (v *Value) AsGoMap(target interface{}) error {
+	if !v.isTable() {
+		return newValueError("table", v)
+	}
+
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Map {
+		return fmt.Errorf("engine: AsGoMap target must be a pointer to a map, got %T", target)
+	}
+
+	mapType := rv.Elem().Type()
+	out := reflect.MakeMap(mapType)
+
+	var err error
+	v.asTable().ForEach(func(k, val lua.LValue) {
+		if err != nil {
+			return
+		}
+		key, ok := k.(lua.LString)
+		if !ok {
+			return
+		}
+
+		elem := reflect.New(mapType.Elem())
+		if convErr := assignLuaValue(val, elem.Elem()); convErr != nil {
+			err = convErr
+			return
+		}
+
+		out.SetMapIndex(reflect.ValueOf(string(key)), elem.Elem())
+	})
+	if err != nil {
+		return err
+	}
+
+	rv.Elem().Set(out)
+
+	return nil
+}
+
+// AsGoSlice fills target, which must be a non-nil pointer to a slice, from
+// this Value's table array part.
+func (v *Value) AsGoSlice(target interface{}) error {
+	if !v.isTable() {
+		return newValueError("table", v)
+	}
+
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("engine: AsGoSlice target must be a pointer to a slice, got %T", target)
+	}
+
+	t := v.asTable()
+	sliceType := rv.Elem().Type()
+	out := reflect.MakeSlice(sliceType, t.Len(), t.Len())
+
+	for i := 1; i <= t.Len(); i++ {
+		if err := assignLuaValue(t.RawGetInt(i), out.Index(i-1)); err != nil {
+			return err
+		}
+	}
+
+	rv.Elem().Set(out)
+
+	return nil
+}
+
+// AsStruct fills target, which must be a non-nil pointer to a struct, from
+// this Value's table. Fields are matched by their `lua:"name"` tag, falling
+// back to the lowercased field name.
+func (v *Value) AsStruct(target interface{}) error {
+	if !v.isTable() {
+		return newValueError("table", v)
+	}
+
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("engine: AsStruct target must be a pointer to a struct, got %T", target)
+	}
+
+	structVal := rv.Elem()
+	structType := structVal.Type()
+
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+
+		lv := v.asTable().RawGetString(luaFieldName(field))
+		if lv == lua.LNil {
+			continue
+		}
+
+		if err := assignLuaValue(lv, structVal.Field(i)); err != nil {
+			return fmt.Errorf("engine: field %q: %v", field.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// luaFieldName returns the table key a struct field is matched against: its
+// `lua` tag if present, otherwise its lowercased name.
+func luaFieldName(field reflect.StructField) string {
+	if tag := field.Tag.Get("lua"); tag != "" {
+		return tag
+	}
+
+	return strings.ToLower(field.Name)
+}
+
+// assignLuaValue converts lv into dst's type and sets it, recursing into
+// maps, slices, and structs as needed.
+func assignLuaValue(lv lua.LValue, dst reflect.Value) error {
+	switch dst.Kind() {
+	case reflect.String:
+		dst.SetString(lua.LVAsString(lv))
+	case reflect.Bool:
+		dst.SetBool(lua.LVAsBool(lv))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		dst.SetInt(int64(lua.LVAsNumber(lv)))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		dst.SetUint(uint64(lua.LVAsNumber(lv)))
+	case reflect.Float32, reflect.Float64:
+		dst.SetFloat(float64(lua.LVAsNumber(lv)))
+	case reflect.Interface:
+		if iface := luaToInterface(lv); iface != nil {
+			dst.Set(reflect.ValueOf(iface))
+		} else {
+			dst.Set(reflect.Zero(dst.Type()))
+		}
+	case reflect.Map:
+		target := reflect.New(dst.Type())
+		if err := newValue(lv).AsGoMap(target.Interface()); err != nil {
+			return err
+		}
+		dst.Set(target.Elem())
+	case reflect.Slice:
+		target := reflect.New(dst.Type())
+		if err := newValue(lv).AsGoSlice(target.Interface()); err != nil {
+			return err
+		}
+		dst.Set(target.Elem())
+	case reflect.Struct:
+		target := reflect.New(dst.Type())
+		if err := newValue(lv).AsStruct(target.Interface()); err != nil {
+			return err
+		}
+		dst.Set(target.Elem())
+	case reflect.Ptr:
+		target := reflect.New(dst.Type().Elem())
+		if err := assignLuaValue(lv, target.Elem()); err != nil {
+			return err
+		}
+		dst.Set(target)
+	default:
+		return fmt.Errorf("engine: cannot convert Lua value into %s", dst.Type())
+	}
+
+	return nil
+}
+
+// luaToInterface converts lv into a plain interface{} (nil, bool, float64,
+// string, []interface{}, or map[string]interface{}), used to fill
+// interface{}-typed struct fields and map/slice elements.
+func luaToInterface(lv lua.LValue) interface{} {
+	switch lv.Type() {
+	case lua.LTNil:
+		return nil
+	case lua.LTBool:
+		return lua.LVAsBool(lv)
+	case lua.LTNumber:
+		return float64(lua.LVAsNumber(lv))
+	case lua.LTString:
+		return lua.LVAsString(lv)
+	case lua.LTTable:
+		t := lv.(*lua.LTable)
+		if t.Len() > 0 {
+			out := make([]interface{}, t.Len())
+			for i := 1; i <= t.Len(); i++ {
+				out[i-1] = luaToInterface(t.RawGetInt(i))
+			}
+
+			return out
+		}
+
+		out := make(map[string]interface{})
+		t.ForEach(func(k, val lua.LValue) {
+			if key, ok := k.(lua.LString); ok {
+				out[string(key)] = luaToInterface(val)
+			}
+		})
+
+		return out
+	default:
+		return lv.String()
+	}
+}
+
+// toLuaValue converts a reflect.Value into its Lua equivalent, building
+// nested tables for maps, slices, arrays, and structs.
+func (e *Engine) toLuaValue(rv reflect.Value) lua.LValue {
+	if !rv.IsValid() {
+		return lua.LNil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return lua.LNil
+		}
+
+		return e.toLuaValue(rv.Elem())
+	case reflect.String:
+		return lua.LString(rv.String())
+	case reflect.Bool:
+		return lua.LBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return lua.LNumber(float64(rv.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return lua.LNumber(float64(rv.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(rv.Float())
+	case reflect.Map:
+		return e.TableFromMap(rv.Interface()).lval
+	case reflect.Slice, reflect.Array:
+		return e.TableFromSlice(rv.Interface()).lval
+	case reflect.Struct:
+		return e.TableFromStruct(rv.Interface()).lval
+	default:
+		return lua.LNil
+	}
+}
+
+// TableFromMap builds a real Lua table from a Go map, recursing into nested
+// maps, slices, and structs. Unlike Engine.ValueFor, this produces a plain
+// LTable rather than a luar userdata proxy.
+func (e *Engine) TableFromMap(m interface{}) *Value {
+	rv := reflect.ValueOf(m)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Map {
+		return newValue(lua.LNil)
+	}
+
+	tbl := e.state.NewTable()
+	for _, key := range rv.MapKeys() {
+		tbl.RawSetString(fmt.Sprint(key.Interface()), e.toLuaValue(rv.MapIndex(key)))
+	}
+
+	return newValue(tbl)
+}
+
+// TableFromSlice builds a real Lua table (array part only) from a Go slice
+// or array, recursing into nested maps, slices, and structs.
+func (e *Engine) TableFromSlice(s interface{}) *Value {
+	rv := reflect.ValueOf(s)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return newValue(lua.LNil)
+	}
+
+	tbl := e.state.NewTable()
+	for i := 0; i < rv.Len(); i++ {
+		tbl.Append(e.toLuaValue(rv.Index(i)))
+	}
+
+	return newValue(tbl)
+}
+
+// TableFromStruct builds a real Lua table from a Go struct, using each
+// field's `lua:"name"` tag (falling back to its lowercased name) as the
+// table key.
+func (e *Engine) TableFromStruct(s interface{}) *Value {
+	rv := reflect.ValueOf(s)
+	for rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return newValue(lua.LNil)
+	}
+
+	tbl := e.state.NewTable()
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+
+		tbl.RawSetString(luaFieldName(field), e.toLuaValue(rv.Field(i)))
+	}
+
+	return newValue(tbl)
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import "testing"
+
+func TestValueAsMapAndAsSlice(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+
+	if err := e.LoadString(`t = {1, 2, 3} m = {a = "x", b = "y"}`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+
+	slice := e.GetGlobal("t").AsSlice()
+	if len(slice) != 3 {
+		t.Fatalf("AsSlice len = %d, want 3", len(slice))
+	}
+	if slice[0].AsNumber() != 1 || slice[2].AsNumber() != 3 {
+		t.Fatalf("AsSlice contents = %v", slice)
+	}
+
+	m := e.GetGlobal("m").AsMap()
+	if len(m) != 2 || m["a"].AsString() != "x" || m["b"].AsString() != "y" {
+		t.Fatalf("AsMap = %v", m)
+	}
+}
+
+func TestValueAsGoSliceAndAsGoMap(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+
+	if err := e.LoadString(`t = {10, 20, 30} m = {a = 1, b = 2}`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+
+	var ints []int
+	if err := e.GetGlobal("t").AsGoSlice(&ints); err != nil {
+		t.Fatalf("AsGoSlice: %v", err)
+	}
+	if len(ints) != 3 || ints[0] != 10 || ints[2] != 30 {
+		t.Fatalf("AsGoSlice = %v", ints)
+	}
+
+	nums := make(map[string]int)
+	if err := e.GetGlobal("m").AsGoMap(&nums); err != nil {
+		t.Fatalf("AsGoMap: %v", err)
+	}
+	if nums["a"] != 1 || nums["b"] != 2 {
+		t.Fatalf("AsGoMap = %v", nums)
+	}
+}
+
+func TestValueAsStructMatchesTagAndLowercasedName(t *testing.T) {
+	type Config struct {
+		Name    string `lua:"name"`
+		Retries int
+	}
+
+	e := NewEngine()
+	defer e.Close()
+
+	if err := e.LoadString(`cfg = {name = "worker", retries = 3}`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+
+	var cfg Config
+	if err := e.GetGlobal("cfg").AsStruct(&cfg); err != nil {
+		t.Fatalf("AsStruct: %v", err)
+	}
+	if cfg.Name != "worker" || cfg.Retries != 3 {
+		t.Fatalf("AsStruct = %+v", cfg)
+	}
+}
+
+func TestEngineTableFromMapSliceStruct(t *testing.T) {
+	type Config struct {
+		Name string `lua:"name"`
+	}
+
+	e := NewEngine()
+	defer e.Close()
+
+	e.SetGlobal("m", e.TableFromMap(map[string]int{"a": 1, "b": 2}))
+	e.SetGlobal("s", e.TableFromSlice([]int{1, 2, 3}))
+	e.SetGlobal("c", e.TableFromStruct(Config{Name: "worker"}))
+
+	if err := e.LoadString(`
+		assert(m.a == 1 and m.b == 2)
+		assert(#s == 3 and s[1] == 1 and s[3] == 3)
+		assert(c.name == "worker")
+	`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"fmt"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// ResumeStatus describes the outcome of a single Coroutine.Resume call.
+type ResumeStatus int
+
+const (
+	// ResumeReturn means the coroutine's function ran to completion and
+	// returned.
+	ResumeReturn ResumeStatus = iota
+
+	// ResumeYield means the coroutine called Yield and is suspended,
+	// waiting for another Resume.
+	ResumeYield
+
+	// ResumeError means the coroutine's function raised an error.
+	ResumeError
+)
+
+// String makes ResumeStatus conform to Stringer.
+func (s ResumeStatus) String() string {
+	switch s {
+	case ResumeReturn:
+		return "return"
+	case ResumeYield:
+		return "yield"
+	case ResumeError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Coroutine wraps a Lua coroutine: a function running on its own child
+// lua.LState, which can be suspended with Yield and resumed with Resume
+// without blocking the Engine it was created from.
+type Coroutine struct {
+	engine *Engine
+	thread *lua.LState
+	fn     *lua.LFunction
+}
+
+// NewCoroutine creates a Coroutine that will run fn, which must wrap a Lua
+// function, on a new child Lua thread.
+func (e *Engine) NewCoroutine(fn *Value) *Coroutine {
+	thread, _ := e.state.NewThread()
+	lfn, _ := fn.lval.(*lua.LFunction)
+
+	return &Coroutine{
+		engine: e,
+		thread: thread,
+		fn:     lfn,
+	}
+}
+
+// Resume starts or continues the coroutine, passing args in as either the
+// function's initial arguments (first Resume) or as the return values of its
+// pending Yield (subsequent Resumes). It reports whether the coroutine
+// returned, yielded, or errored, along with whatever values it passed back.
+//
+// Resume runs under c.engine's lock: gopher-lua's Resume mutates state on
+// the parent LState, not just the child thread, so it can't safely run
+// concurrently with another Resume, Call, or Load* on the same Engine.
+func (c *Coroutine) Resume(args ...interface{}) (ResumeStatus, []*Value, error) {
+	c.engine.mu.Lock()
+	defer c.engine.mu.Unlock()
+
+	return c.resumeLocked(args...)
+}
+
+// resumeLocked is Resume's body, factored out so CallAsync can hold
+// c.engine's lock across a whole run-to-completion loop of resumes instead
+// of re-acquiring it (and re-entering, which sync.Mutex doesn't allow) on
+// every yield.
+func (c *Coroutine) resumeLocked(args ...interface{}) (ResumeStatus, []*Value, error) {
+	if c.fn == nil {
+		return ResumeError, nil, fmt.Errorf("engine: NewCoroutine was not given a Lua function")
+	}
+
+	luaArgs := make([]lua.LValue, len(args))
+	for i, a := range args {
+		luaArgs[i] = c.engine.ValueFor(a).lval
+	}
+
+	state, err, retVals := c.engine.state.Resume(c.thread, c.fn, luaArgs...)
+
+	values := make([]*Value, len(retVals))
+	for i, rv := range retVals {
+		values[i] = newValue(rv)
+	}
+
+	switch state {
+	case lua.ResumeOK:
+		return ResumeReturn, values, err
+	case lua.ResumeYield:
+		return ResumeYield, values, err
+	default:
+		return ResumeError, values, err
+	}
+}
+
+// Yield suspends the coroutine, passing values back to whoever called
+// Resume. It must be called from within the coroutine's own thread, i.e.
+// from a Go function registered on an Engine wrapping c's child LState.
+func (c *Coroutine) Yield(values ...interface{}) {
+	luaVals := make([]lua.LValue, len(values))
+	for i, v := range values {
+		luaVals[i] = c.engine.ValueFor(v).lval
+	}
+
+	c.thread.Yield(luaVals...)
+}
+
+// Status returns the coroutine's current status, one of "suspended",
+// "running", "normal", or "dead", mirroring Lua's coroutine.status.
+func (c *Coroutine) Status() string {
+	return c.engine.state.Status(c.thread)
+}
+
+// CallResult carries the outcome of a CallAsync invocation back to its
+// caller.
+type CallResult struct {
+	Values []*Value
+	Err    error
+}
+
+// CallAsync runs the global function named name as a coroutine on its own
+// child Lua thread, in a separate goroutine, and reports the result on the
+// returned channel once the function runs to completion or errors. This
+// lets a server dispatch scripted work (timers, background jobs) without
+// blocking its own request path.
+//
+// If the function yields, CallAsync resumes it again (passing no further
+// values, since nothing is waiting to supply them) and keeps doing so until
+// it returns or errors; CallResult always reflects that final outcome, not
+// an intermediate yield. The whole run holds e's lock, so a concurrent
+// Call, Load*, or second CallAsync on the same Engine blocks until this one
+// finishes rather than racing it.
+func (e *Engine) CallAsync(name string, retCount int, params ...interface{}) <-chan CallResult {
+	result := make(chan CallResult, 1)
+
+	go func() {
+		defer close(result)
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		lfn, ok := e.state.GetGlobal(name).(*lua.LFunction)
+		if !ok {
+			result <- CallResult{Err: fmt.Errorf("engine: %q is not a Lua function", name)}
+			return
+		}
+
+		thread, _ := e.state.NewThread()
+		co := &Coroutine{engine: e, thread: thread, fn: lfn}
+
+		status, values, err := co.resumeLocked(params...)
+		for status == ResumeYield && err == nil {
+			status, values, err = co.resumeLocked()
+		}
+		if len(values) > retCount {
+			values = values[:retCount]
+		}
+
+		result <- CallResult{Values: values, Err: err}
+	}()
+
+	return result
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoroutineResumeYieldThenReturn(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+
+	if err := e.LoadString(`
+		function task()
+			coroutine.yield(1)
+			return 2
+		end
+	`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+
+	fn := e.GetGlobal("task")
+	co := e.NewCoroutine(fn)
+
+	status, values, err := co.Resume()
+	if err != nil {
+		t.Fatalf("first Resume: %v", err)
+	}
+	if status != ResumeYield {
+		t.Fatalf("first Resume status = %v, want ResumeYield", status)
+	}
+	if len(values) != 1 || values[0].AsNumber() != 1 {
+		t.Fatalf("first Resume values = %v, want [1]", values)
+	}
+
+	status, values, err = co.Resume()
+	if err != nil {
+		t.Fatalf("second Resume: %v", err)
+	}
+	if status != ResumeReturn {
+		t.Fatalf("second Resume status = %v, want ResumeReturn", status)
+	}
+	if len(values) != 1 || values[0].AsNumber() != 2 {
+		t.Fatalf("second Resume values = %v, want [2]", values)
+	}
+}
+
+func TestCallAsyncResumesPastYieldToFinalReturn(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+
+	if err := e.LoadString(`
+		function task()
+			coroutine.yield(1)
+			coroutine.yield(2)
+			return 3
+		end
+	`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+
+	res := <-e.CallAsync("task", 1)
+	if res.Err != nil {
+		t.Fatalf("CallAsync: %v", res.Err)
+	}
+	if len(res.Values) != 1 || res.Values[0].AsNumber() != 3 {
+		t.Fatalf("CallAsync values = %v, want [3] (the coroutine's eventual return, not an intermediate yield)", res.Values)
+	}
+}
+
+func TestCallAsyncConcurrentCallsDoNotRace(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+
+	if err := e.LoadString(`
+		function task(n)
+			coroutine.yield(n)
+			return n * 2
+		end
+	`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+
+			res := <-e.CallAsync("task", 1, n)
+			if res.Err != nil {
+				t.Errorf("CallAsync(%d): %v", n, res.Err)
+				return
+			}
+			if len(res.Values) != 1 || int(res.Values[0].AsNumber()) != n*2 {
+				t.Errorf("CallAsync(%d) values = %v, want [%d]", n, res.Values, n*2)
+			}
+		}(i + 1)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CallAsync calls did not complete, possible deadlock")
+	}
+}
+
+func TestCoroutineStatus(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+
+	if err := e.LoadString(`
+		function task()
+			coroutine.yield()
+		end
+	`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+
+	co := e.NewCoroutine(e.GetGlobal("task"))
+	if got := co.Status(); got != "suspended" {
+		t.Fatalf("Status before Resume = %q, want \"suspended\"", got)
+	}
+
+	if _, _, err := co.Resume(); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if got := co.Status(); got != "suspended" {
+		t.Fatalf("Status after yield = %q, want \"suspended\"", got)
+	}
+
+	if _, _, err := co.Resume(); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if got := co.Status(); got != "dead" {
+		t.Fatalf("Status after return = %q, want \"dead\"", got)
+	}
+}
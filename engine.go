@@ -3,6 +3,8 @@
 package engine
 
 import (
+	"sync"
+
 	"github.com/layeh/gopher-luar"
 	"github.com/yuin/gopher-lua"
 )
@@ -10,6 +12,31 @@ import (
 // Engine struct stores a pointer to a lua.LState providing a simplified API.
 type Engine struct {
 	state *lua.LState
+
+	// mu serializes every entry point that drives e.state: LoadFile,
+	// LoadString, Call, LoadChunk, CallChunk, and Coroutine.Resume.
+	// lua.LState is not safe for concurrent use (the same hazard Pool
+	// exists to keep separate Engines from sharing), and Resume in
+	// particular mutates state on the parent LState, not just the child
+	// thread, so two of these running at once on the same Engine (e.g.
+	// from two CallAsync calls) would race. Calls simply block one
+	// another rather than running in parallel; use a Pool of Engines for
+	// real concurrency.
+	mu sync.Mutex
+
+	// Meta holds arbitrary per-engine data. Engines checked out of a Pool use
+	// it (under EnginePoolKey) to find their way back to that Pool on
+	// Release.
+	Meta map[string]interface{}
+
+	// sandbox holds this Engine's resource limits and whitelist when it was
+	// created via NewSandboxedEngine or Engine.Sandbox. nil for unrestricted
+	// engines.
+	sandbox *sandboxConfig
+
+	// errorHandler, if set via SetErrorHandler, is called with every
+	// ScriptError produced by this Engine.
+	errorHandler func(*ScriptError)
 }
 
 // ScriptFunction is a type alias for a function that receives an Engine and
@@ -23,6 +50,7 @@ type ScriptFnMap map[string]ScriptFunction
 func NewEngine() *Engine {
 	return &Engine{
 		state: lua.NewState(),
+		Meta:  make(map[string]interface{}),
 	}
 }
 
@@ -33,12 +61,26 @@ func (e *Engine) Close() {
 
 // LoadFile runs the file through the Lua interpreter.
 func (e *Engine) LoadFile(fn string) error {
-	return e.state.DoFile(fn)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.withLimits(func() error {
+		return e.loadAndRun(fn, func() (*lua.LFunction, error) {
+			return e.state.LoadFile(fn)
+		})
+	})
 }
 
 // LoadString runs the given string through the Lua interpreter.
 func (e *Engine) LoadString(src string) error {
-	return e.state.DoString(src)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.withLimits(func() error {
+		return e.loadAndRun("<string>", func() (*lua.LFunction, error) {
+			return e.state.LoadString(src)
+		})
+	})
 }
 
 // SetVal allows for setting global variables in the loaded code.
@@ -73,12 +115,13 @@ func (e *Engine) RegisterFunc(name string, fn interface{}) {
 		lfn = v.lval
 	}
 	e.state.SetGlobal(name, lfn)
+	e.allowInSandbox(name)
 }
 
 // RegisterModule registers a Go module with the Engine for use within Lua.
 func (e *Engine) RegisterModule(name string, loadFn func(*Engine) *Value) {
 	loader := func(l *lua.LState) int {
-		e := &Engine{l}
+		e := &Engine{state: l}
 		mod := loadFn(e)
 		e.PushRet(mod)
 
@@ -194,22 +237,33 @@ func (e *Engine) Call(name string, retCount int, params ...interface{}) ([]*Valu
 		luaParams[i] = v.lval
 	}
 
-	err := e.state.CallByParam(lua.P{
-		Fn:      e.state.GetGlobal(name),
-		NRet:    retCount,
-		Protect: true,
-	}, luaParams...)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var retVals []*Value
+	err := e.withLimits(func() error {
+		err := e.state.CallByParam(lua.P{
+			Fn:      e.state.GetGlobal(name),
+			NRet:    retCount,
+			Protect: true,
+		}, luaParams...)
+		if err != nil {
+			return e.wrapError(name, err)
+		}
+
+		retVals = make([]*Value, retCount)
+		for i := 0; i < retCount; i++ {
+			retVals[i] = newValue(e.state.Get(-retCount + i))
+		}
+		e.state.Pop(retCount)
+
+		return nil
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	retVals := make([]*Value, retCount)
-	for i := 0; i < retCount; i++ {
-		retVals[i] = newValue(e.state.Get(-1))
-	}
-	e.state.Pop(retCount)
-
 	return retVals, nil
 }
 
@@ -237,9 +291,15 @@ func (e *Engine) LuaTable() *Value {
 // wrapScriptFunction turns a ScriptFunction into a lua.LGFunction
 func (e *Engine) wrapScriptFunction(fn ScriptFunction) lua.LGFunction {
 	return func(l *lua.LState) int {
-		e := &Engine{state: l}
+		if e.sandbox != nil {
+			if err := e.sandbox.checkBudget(); err != nil {
+				l.RaiseError(err.Error())
+			}
+		}
+
+		inner := &Engine{state: l}
 
-		return fn(e)
+		return fn(inner)
 	}
 }
 
@@ -0,0 +1,119 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// errorLocation extracts the "chunkname:line: " prefix Lua puts on its
+// error messages.
+var errorLocation = regexp.MustCompile(`^(.*):(\d+): (.*)$`)
+
+// ScriptError describes a failure loading or calling a script, carrying the
+// traceback and source location that a raw error loses.
+type ScriptError struct {
+	// Message is the error text with its "source:line: " prefix stripped.
+	Message string
+
+	// Source is the chunk name (file path, or the name passed to
+	// CompileString/Call) the error occurred in.
+	Source string
+
+	// Line is the line number the error occurred on, or 0 if it couldn't be
+	// determined.
+	Line int
+
+	// Traceback is the Lua stack traceback captured at the point of
+	// failure, if one was available (gopher-lua only records one for
+	// errors raised while a function is running, not for load-time
+	// parse/syntax errors).
+	Traceback string
+
+	// Cause is the original error returned by gopher-lua.
+	Cause error
+}
+
+// Error makes ScriptError conform to the error interface.
+func (s *ScriptError) Error() string {
+	if s.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", s.Source, s.Line, s.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", s.Source, s.Message)
+}
+
+// SetErrorHandler installs a global hook that fn is called with every
+// ScriptError this Engine produces, so hosts can log tracebacks centrally
+// instead of handling every call site individually.
+func (e *Engine) SetErrorHandler(fn func(*ScriptError)) {
+	e.errorHandler = fn
+}
+
+// wrapError turns a raw gopher-lua error into a ScriptError and invokes the
+// Engine's error handler if one is set. chunkName is used as a fallback
+// Source when the raw error has no location prefix of its own.
+//
+// When cause is a *lua.ApiError (true of every error LoadFile, LoadString,
+// and CallByParam can return), its Object carries the raw
+// "chunkname:line: message" text and, for errors raised while a function
+// was running, its StackTrace carries the traceback gopher-lua captured via
+// CallByParam's built-in error path — no custom lua.P.Handler is needed to
+// obtain it.
+func (e *Engine) wrapError(chunkName string, cause error) *ScriptError {
+	source := chunkName
+	line := 0
+	message := cause.Error()
+	traceback := ""
+
+	if apiErr, ok := cause.(*lua.ApiError); ok {
+		message = apiErr.Object.String()
+		traceback = apiErr.StackTrace
+	}
+
+	if m := errorLocation.FindStringSubmatch(message); m != nil {
+		source = m[1]
+		if n, err := fmt.Sscanf(m[2], "%d", &line); err != nil || n != 1 {
+			line = 0
+		}
+		message = m[3]
+	}
+
+	scriptErr := &ScriptError{
+		Message:   message,
+		Source:    source,
+		Line:      line,
+		Traceback: traceback,
+		Cause:     cause,
+	}
+
+	if e.errorHandler != nil {
+		e.errorHandler(scriptErr)
+	}
+
+	return scriptErr
+}
+
+// loadAndRun loads a chunk via load and, if that succeeds, calls it
+// protected, wrapping any failure (from either step) into a *ScriptError
+// attributed to chunkName.
+func (e *Engine) loadAndRun(chunkName string, load func() (*lua.LFunction, error)) error {
+	fn, err := load()
+	if err != nil {
+		return e.wrapError(chunkName, err)
+	}
+
+	err = e.state.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    0,
+		Protect: true,
+	})
+	if err != nil {
+		return e.wrapError(chunkName, err)
+	}
+
+	return nil
+}
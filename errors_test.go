@@ -0,0 +1,94 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrapErrorPopulatesSourceLineAndMessage(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+
+	err := e.LoadString("x = 1\nerror(\"boom\")")
+	if err == nil {
+		t.Fatal("expected LoadString to return an error")
+	}
+
+	scriptErr, ok := err.(*ScriptError)
+	if !ok {
+		t.Fatalf("err is %T, want *ScriptError", err)
+	}
+	if scriptErr.Line != 2 {
+		t.Fatalf("Line = %d, want 2", scriptErr.Line)
+	}
+	if scriptErr.Message != "boom" {
+		t.Fatalf("Message = %q, want %q", scriptErr.Message, "boom")
+	}
+	if scriptErr.Source != "<string>" {
+		t.Fatalf("Source = %q, want %q", scriptErr.Source, "<string>")
+	}
+	if scriptErr.Cause == nil {
+		t.Fatal("Cause is nil, want the original gopher-lua error")
+	}
+}
+
+func TestWrapErrorCapturesTracebackForRuntimeError(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+
+	err := e.LoadString(`
+		function fails()
+			error("boom")
+		end
+		fails()
+	`)
+	if err == nil {
+		t.Fatal("expected LoadString to return an error")
+	}
+
+	scriptErr, ok := err.(*ScriptError)
+	if !ok {
+		t.Fatalf("err is %T, want *ScriptError", err)
+	}
+	if scriptErr.Traceback == "" {
+		t.Fatal("Traceback is empty, want a captured stack trace")
+	}
+	if !strings.Contains(scriptErr.Traceback, "fails") {
+		t.Fatalf("Traceback = %q, want it to mention the failing function", scriptErr.Traceback)
+	}
+}
+
+func TestSetErrorHandlerIsCalledWithScriptError(t *testing.T) {
+	e := NewEngine()
+	defer e.Close()
+
+	var got *ScriptError
+	e.SetErrorHandler(func(se *ScriptError) {
+		got = se
+	})
+
+	if err := e.LoadString(`error("boom")`); err == nil {
+		t.Fatal("expected LoadString to return an error")
+	}
+
+	if got == nil {
+		t.Fatal("error handler was never invoked")
+	}
+	if got.Message != "boom" {
+		t.Fatalf("handler received Message = %q, want %q", got.Message, "boom")
+	}
+}
+
+func TestScriptErrorErrorFormatsWithAndWithoutLine(t *testing.T) {
+	withLine := &ScriptError{Source: "foo.lua", Line: 3, Message: "bad"}
+	if got, want := withLine.Error(), "foo.lua:3: bad"; got != want {
+		t.Fatalf("Error() = %q, want %q", got, want)
+	}
+
+	withoutLine := &ScriptError{Source: "foo.lua", Message: "bad"}
+	if got, want := withoutLine.Error(), "foo.lua: bad"; got != want {
+		t.Fatalf("Error() = %q, want %q", got, want)
+	}
+}
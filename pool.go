@@ -0,0 +1,202 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"errors"
+	"sync"
+)
+
+// EnginePoolKey is the key under which an Engine checked out of a Pool
+// stores a reference back to that Pool in its Meta map, so Engine.Release
+// can hand itself back in without the caller needing to keep the Pool
+// around separately.
+const EnginePoolKey = "__pool"
+
+// ErrPoolClosed is returned by Acquire and Do once the Pool has been closed.
+// TryAcquire reports a closed Pool by returning false.
+var ErrPoolClosed = errors.New("engine: pool is closed")
+
+// Loader is run once against every Engine a Pool creates, right after
+// creation, to preload modules and globals before the Engine is handed out.
+type Loader func(*Engine) error
+
+// Pool manages a set of *Engine instances for concurrent script execution.
+// A lua.LState is not safe for concurrent use, so a Pool lets callers check
+// an Engine out, use it from a single goroutine at a time, and check it back
+// in when done, similar in spirit to a sync.Pool but bounded to a maximum
+// engine count.
+type Pool struct {
+	loader Loader
+	max    int
+	idle   chan *Engine
+
+	mu      sync.Mutex
+	created int
+	closed  bool
+}
+
+// NewPool creates a Pool that will lazily create up to max engines, running
+// loader against each one exactly once, right after it is created and
+// before it is first handed out. loader may be nil.
+func NewPool(max int, loader Loader) *Pool {
+	return &Pool{
+		loader: loader,
+		max:    max,
+		idle:   make(chan *Engine, max),
+	}
+}
+
+// Acquire checks out an Engine, blocking until one is available if the pool
+// is already at its max engine count.
+func (p *Pool) Acquire() (*Engine, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		select {
+		case e := <-p.idle:
+			p.mu.Unlock()
+			return e, nil
+		default:
+		}
+
+		if p.created < p.max {
+			p.created++
+			p.mu.Unlock()
+
+			e, err := p.newEngine()
+			if err != nil {
+				p.mu.Lock()
+				p.created--
+				p.mu.Unlock()
+
+				return nil, err
+			}
+
+			return e, nil
+		}
+		p.mu.Unlock()
+
+		e, ok := <-p.idle
+		if !ok {
+			return nil, ErrPoolClosed
+		}
+
+		return e, nil
+	}
+}
+
+// TryAcquire is the non-blocking form of Acquire. It returns false if the
+// pool is at its max engine count and no engine is currently idle.
+func (p *Pool) TryAcquire() (*Engine, bool) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, false
+	}
+
+	select {
+	case e := <-p.idle:
+		p.mu.Unlock()
+		return e, true
+	default:
+	}
+
+	if p.created >= p.max {
+		p.mu.Unlock()
+		return nil, false
+	}
+	p.created++
+	p.mu.Unlock()
+
+	e, err := p.newEngine()
+	if err != nil {
+		p.mu.Lock()
+		p.created--
+		p.mu.Unlock()
+
+		return nil, false
+	}
+
+	return e, true
+}
+
+// Release returns an Engine to the pool so that it can be reused by a future
+// Acquire. Engines returned after the pool has been closed are closed
+// instead. The closed check and the send onto idle happen under the same
+// lock Close uses to close that channel, so a Release can never race a
+// concurrent Close into sending on a closed channel.
+func (p *Pool) Release(e *Engine) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		e.Close()
+		return
+	}
+
+	select {
+	case p.idle <- e:
+	default:
+		// idle is already full; this shouldn't happen since we never hand
+		// out more than max engines, but close defensively rather than leak.
+		e.Close()
+	}
+}
+
+// Do checks an Engine out, invokes fn with it, and releases it back to the
+// pool once fn returns, regardless of error.
+func (p *Pool) Do(fn func(*Engine) error) error {
+	e, err := p.Acquire()
+	if err != nil {
+		return err
+	}
+	defer p.Release(e)
+
+	return fn(e)
+}
+
+// Close marks the pool as closed and closes every currently idle Engine.
+// Engines still checked out are closed as they are returned via Release.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.idle)
+	p.mu.Unlock()
+
+	for e := range p.idle {
+		e.Close()
+	}
+}
+
+// newEngine creates a new Engine, tags it with a reference back to this
+// Pool, and runs the pool's Loader against it.
+func (p *Pool) newEngine() (*Engine, error) {
+	e := NewEngine()
+	e.Meta[EnginePoolKey] = p
+
+	if p.loader != nil {
+		if err := p.loader(e); err != nil {
+			e.Close()
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// Release returns the Engine to the Pool it was checked out from, if any. It
+// is a no-op for engines not obtained from a Pool.
+func (e *Engine) Release() {
+	if p, ok := e.Meta[EnginePoolKey].(*Pool); ok {
+		p.Release(e)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPoolAcquireRespectsMax(t *testing.T) {
+	p := NewPool(2, nil)
+	defer p.Close()
+
+	e1, err := p.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	e2, err := p.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	if _, ok := p.TryAcquire(); ok {
+		t.Fatal("TryAcquire succeeded past the pool's max engine count")
+	}
+
+	p.Release(e1)
+
+	e3, ok := p.TryAcquire()
+	if !ok {
+		t.Fatal("TryAcquire failed after an engine was released")
+	}
+
+	p.Release(e2)
+	p.Release(e3)
+}
+
+func TestPoolRunsLoaderOncePerEngine(t *testing.T) {
+	var mu sync.Mutex
+	loaded := 0
+
+	p := NewPool(3, func(e *Engine) error {
+		mu.Lock()
+		loaded++
+		mu.Unlock()
+
+		return nil
+	})
+	defer p.Close()
+
+	// Acquire all 3 engines before releasing any, so every Acquire must
+	// create a fresh engine instead of reusing one a faster goroutine
+	// already released back to idle.
+	engines := make([]*Engine, 3)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			e, err := p.Acquire()
+			if err != nil {
+				t.Errorf("Acquire: %v", err)
+				return
+			}
+			engines[i] = e
+		}(i)
+	}
+	wg.Wait()
+
+	for _, e := range engines {
+		p.Release(e)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if loaded != 3 {
+		t.Fatalf("loader ran %d times, want 3", loaded)
+	}
+}
+
+func TestPoolDoReleasesEngine(t *testing.T) {
+	p := NewPool(1, nil)
+	defer p.Close()
+
+	if err := p.Do(func(e *Engine) error {
+		e.SetGlobal("x", 1)
+		return nil
+	}); err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+
+	if _, ok := p.TryAcquire(); !ok {
+		t.Fatal("Do did not release its engine back to the pool")
+	}
+}
+
+func TestEngineReleaseReturnsToItsPool(t *testing.T) {
+	p := NewPool(1, nil)
+	defer p.Close()
+
+	e, err := p.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	e.Release()
+
+	if _, ok := p.TryAcquire(); !ok {
+		t.Fatal("Engine.Release did not hand the engine back to its Pool")
+	}
+}
+
+func TestPoolReleaseAfterCloseDoesNotPanic(t *testing.T) {
+	p := NewPool(1, nil)
+
+	e, err := p.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	p.Release(e)
+
+	p.Close()
+
+	// Releasing after Close should close the engine rather than panic on a
+	// send to the now-closed idle channel.
+	e2, err := p.newEngine()
+	if err != nil {
+		t.Fatalf("newEngine: %v", err)
+	}
+	p.Release(e2)
+}
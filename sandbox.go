@@ -0,0 +1,216 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// DefaultWhitelist is the set of standard library modules exposed by a
+// sandboxed Engine when SandboxOptions.Whitelist is left nil.
+var DefaultWhitelist = []string{"string", "table", "math"}
+
+// forbiddenModules can never be whitelisted, since they let a script reach
+// outside the sandbox (the filesystem, the environment, other scripts'
+// internals).
+var forbiddenModules = map[string]bool{
+	"os":      true,
+	"io":      true,
+	"debug":   true,
+	"package": true,
+}
+
+// alwaysSafeGlobals are base-library globals kept regardless of Whitelist,
+// since scripts are unusable without them.
+var alwaysSafeGlobals = map[string]bool{
+	"print": true, "type": true, "tostring": true, "tonumber": true,
+	"pairs": true, "ipairs": true, "next": true, "select": true,
+	"error": true, "assert": true, "pcall": true, "xpcall": true,
+	"setmetatable": true, "getmetatable": true, "rawget": true,
+	"rawset": true, "rawequal": true, "rawlen": true, "unpack": true,
+	"_G": true, "_VERSION": true,
+}
+
+// forbiddenGlobals are always stripped, even if present under a whitelisted
+// name, since they let a script load or inspect arbitrary code.
+var forbiddenGlobals = map[string]bool{
+	"loadfile": true, "dofile": true, "require": true, "load": true,
+	"collectgarbage": true, "module": true,
+}
+
+// sandboxRegistryKey is where a sandboxed Engine stores its whitelist in the
+// Lua registry, so the set of allowed names is visible to code running
+// inside the state (and is kept current as RegisterFunc adds to it).
+const sandboxRegistryKey = "__sandbox_whitelist"
+
+// SandboxOptions configures the restrictions NewSandboxedEngine and
+// Engine.Sandbox place on scripts.
+type SandboxOptions struct {
+	// Whitelist names the standard library modules to expose to scripts.
+	// Defaults to DefaultWhitelist. "os", "io", "debug", and "package" can
+	// never be whitelisted.
+	Whitelist []string
+
+	// MaxCalls aborts a running script when it makes more than this many
+	// calls into Go functions of type func(*Engine) int registered with
+	// RegisterFunc (directly, or through a module built with
+	// GenerateModule). Other Go values passed to RegisterFunc are wrapped by
+	// luar and their calls are not counted. Zero means
+	// unlimited. gopher-lua exposes no VM-level instruction hook, so this
+	// is the closest available proxy for "the script is doing too much" —
+	// a tight pure-Lua loop that never calls back into Go is bounded only
+	// by Timeout.
+	MaxCalls int
+
+	// Timeout aborts a running script once this much wall-clock time has
+	// elapsed. Zero means unlimited.
+	Timeout time.Duration
+
+	// MaxMemory aborts a running script once the Go heap has grown past
+	// this many bytes. Zero means unlimited. Checked at the same points as
+	// MaxCalls, for the same reason: gopher-lua has no per-state allocator
+	// to hook, so this can only be checked at Go call boundaries, not on
+	// every Lua allocation.
+	MaxMemory int
+}
+
+// sandboxConfig is the resolved, per-Engine state backing a sandbox.
+type sandboxConfig struct {
+	opts      SandboxOptions
+	whitelist map[string]bool
+	calls     int
+}
+
+// checkBudget is called on every entry into a ScriptFunction registered on a
+// sandboxed Engine via RegisterFunc or GenerateModule. It returns an error once MaxCalls or MaxMemory has been
+// exceeded, which the caller should turn into a Lua error via RaiseError.
+func (c *sandboxConfig) checkBudget() error {
+	if c.opts.MaxCalls <= 0 && c.opts.MaxMemory <= 0 {
+		return nil
+	}
+
+	c.calls++
+	if c.opts.MaxCalls > 0 && c.calls > c.opts.MaxCalls {
+		return fmt.Errorf("sandbox: call budget of %d exceeded", c.opts.MaxCalls)
+	}
+
+	if c.opts.MaxMemory > 0 {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		if int(mem.Alloc) > c.opts.MaxMemory {
+			return fmt.Errorf("sandbox: memory limit of %d bytes exceeded", c.opts.MaxMemory)
+		}
+	}
+
+	return nil
+}
+
+// NewSandboxedEngine creates an Engine whose scripts are restricted
+// according to opts: only whitelisted standard library modules are visible,
+// and long-running or resource-hungry scripts are aborted.
+func NewSandboxedEngine(opts SandboxOptions) *Engine {
+	e := NewEngine()
+	e.Sandbox(opts)
+
+	return e
+}
+
+// Sandbox applies the given restrictions to an existing Engine, replacing
+// its globals table with a filtered copy and arming the limits that
+// LoadFile, LoadString, and Call will enforce from now on.
+func (e *Engine) Sandbox(opts SandboxOptions) {
+	whitelist := opts.Whitelist
+	if whitelist == nil {
+		whitelist = DefaultWhitelist
+	}
+
+	allowed := make(map[string]bool, len(whitelist))
+	for _, name := range whitelist {
+		if !forbiddenModules[name] {
+			allowed[name] = true
+		}
+	}
+
+	e.sandbox = &sandboxConfig{opts: opts, whitelist: allowed}
+	e.filterGlobals(allowed)
+	e.syncSandboxRegistry()
+}
+
+// filterGlobals removes every global that isn't either a whitelisted module,
+// one of alwaysSafeGlobals, or a name RegisterFunc added, and always strips
+// forbiddenGlobals.
+func (e *Engine) filterGlobals(allowed map[string]bool) {
+	table, ok := e.state.Get(lua.GlobalsIndex).(*lua.LTable)
+	if !ok {
+		return
+	}
+
+	var drop []string
+	table.ForEach(func(k, v lua.LValue) {
+		name, ok := k.(lua.LString)
+		if !ok {
+			return
+		}
+
+		n := string(name)
+		if forbiddenGlobals[n] || !(allowed[n] || alwaysSafeGlobals[n]) {
+			drop = append(drop, n)
+		}
+	})
+
+	for _, name := range drop {
+		table.RawSetString(name, lua.LNil)
+	}
+}
+
+// syncSandboxRegistry writes this Engine's current whitelist into the Lua
+// registry, overwriting whatever was there before.
+func (e *Engine) syncSandboxRegistry() {
+	if e.sandbox == nil {
+		return
+	}
+
+	tbl := e.state.NewTable()
+	for name := range e.sandbox.whitelist {
+		tbl.RawSetString(name, lua.LTrue)
+	}
+
+	e.state.SetField(e.state.Get(lua.RegistryIndex), sandboxRegistryKey, tbl)
+}
+
+// allowInSandbox records name as explicitly allowed, so code inspecting the
+// registry whitelist (or a later call to filterGlobals) knows RegisterFunc
+// put it there deliberately. It is a no-op on unsandboxed engines.
+func (e *Engine) allowInSandbox(name string) {
+	if e.sandbox == nil {
+		return
+	}
+
+	e.sandbox.whitelist[name] = true
+	e.syncSandboxRegistry()
+}
+
+// withLimits runs fn with this Engine's wall-clock timeout armed, if it is
+// sandboxed. Unsandboxed engines run fn directly. The call-count and memory
+// ceiling are enforced separately, at the point scripts call into
+// registered Go functions; see sandboxConfig.checkBudget.
+func (e *Engine) withLimits(fn func() error) error {
+	if e.sandbox == nil {
+		return fn()
+	}
+
+	if e.sandbox.opts.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), e.sandbox.opts.Timeout)
+		defer cancel()
+
+		e.state.SetContext(ctx)
+		defer e.state.RemoveContext()
+	}
+
+	return fn()
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2015 tree-server contributors
+
+package engine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSandboxStripsNonWhitelistedGlobals(t *testing.T) {
+	e := NewSandboxedEngine(SandboxOptions{Whitelist: []string{"string"}})
+	defer e.Close()
+
+	if err := e.LoadString(`has_string = type(string) == "table"`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+	if !e.GetGlobal("has_string").AsBool() {
+		t.Fatal("whitelisted module \"string\" was stripped")
+	}
+
+	err := e.LoadString(`return os.time()`)
+	if err == nil {
+		t.Fatal("expected indexing the stripped os global to fail, got nil")
+	}
+	if !strings.Contains(err.Error(), "nil") {
+		t.Fatalf("error = %v, want it to report os as nil (stripped)", err)
+	}
+}
+
+func TestSandboxForbiddenModuleCannotBeWhitelisted(t *testing.T) {
+	e := NewSandboxedEngine(SandboxOptions{Whitelist: []string{"os", "io", "debug", "package"}})
+	defer e.Close()
+
+	err := e.LoadString(`return os.time()`)
+	if err == nil {
+		t.Fatal("expected whitelisting \"os\" to have no effect, got no error")
+	}
+}
+
+func TestSandboxStripsForbiddenGlobalsEvenIfWhitelisted(t *testing.T) {
+	e := NewSandboxedEngine(SandboxOptions{Whitelist: []string{"load"}})
+	defer e.Close()
+
+	err := e.LoadString(`return load("return 1")`)
+	if err == nil {
+		t.Fatal("expected load to be stripped, got no error")
+	}
+}
+
+func TestSandboxMaxCallsAbortsScript(t *testing.T) {
+	e := NewSandboxedEngine(SandboxOptions{MaxCalls: 2})
+	defer e.Close()
+
+	calls := 0
+	e.RegisterFunc("work", func(inner *Engine) int {
+		calls++
+		return 0
+	})
+
+	err := e.LoadString(`
+		work()
+		work()
+		work()
+	`)
+	if err == nil {
+		t.Fatal("expected the call budget to abort the script, got no error")
+	}
+	if calls != 2 {
+		t.Fatalf("work() ran %d times before the budget error aborted the 3rd call, want 2", calls)
+	}
+}
+
+func TestSandboxMaxCallsZeroMeansUnlimited(t *testing.T) {
+	e := NewSandboxedEngine(SandboxOptions{})
+	defer e.Close()
+
+	e.RegisterFunc("work", func(inner *Engine) int {
+		return 0
+	})
+
+	if err := e.LoadString(`
+		for i = 1, 100 do
+			work()
+		end
+	`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+}
+
+func TestSandboxTimeoutAbortsScript(t *testing.T) {
+	e := NewSandboxedEngine(SandboxOptions{Timeout: 10 * time.Millisecond})
+	defer e.Close()
+
+	err := e.LoadString(`
+		local x = 0
+		while true do
+			x = x + 1
+		end
+	`)
+	if err == nil {
+		t.Fatal("expected the timeout to abort the infinite loop, got no error")
+	}
+}
+
+func TestEngineRegisterFuncIsAllowedAfterSandboxing(t *testing.T) {
+	e := NewSandboxedEngine(SandboxOptions{Whitelist: []string{}})
+	defer e.Close()
+
+	e.RegisterFunc("greet", func(inner *Engine) int {
+		inner.PushRet("hi")
+		return 1
+	})
+
+	if err := e.LoadString(`assert(greet() == "hi")`); err != nil {
+		t.Fatalf("LoadString: %v", err)
+	}
+}
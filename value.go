@@ -33,6 +33,11 @@ func newValue(val lua.LValue) *Value {
 	}
 }
 
+// LuaNil returns a Value wrapping Lua's nil.
+func LuaNil() *Value {
+	return newValue(lua.LNil)
+}
+
 // String makes Value conform to Stringer
 func (v *Value) String() string {
 	return v.lval.String()